@@ -0,0 +1,130 @@
+// Package bridge pushes metrics gathered from a prometheus.Gatherer to a
+// Graphite/Carbon server in the plaintext protocol, so that munin_exporter
+// can dual-publish to a legacy Graphite installation alongside Prometheus.
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// HandlerErrorHandling defines how a Bridge should behave when a Push
+// fails: either log the error and keep running, or abort Run entirely.
+type HandlerErrorHandling int
+
+const (
+	// ContinueOnError keeps the bridge running after a failed push, logging
+	// the error and trying again on the next interval.
+	ContinueOnError HandlerErrorHandling = iota
+	// AbortOnError stops Run as soon as a push fails.
+	AbortOnError
+)
+
+const proto = "tcp"
+
+// Bridge periodically gathers metrics and writes them to a Graphite server.
+type Bridge struct {
+	Address       string
+	Interval      time.Duration
+	ErrorHandling HandlerErrorHandling
+	Gatherer      prometheus.Gatherer
+}
+
+// New returns a Bridge ready to Run.
+func New(address string, interval time.Duration, errorHandling HandlerErrorHandling, gatherer prometheus.Gatherer) *Bridge {
+	return &Bridge{
+		Address:       address,
+		Interval:      interval,
+		ErrorHandling: errorHandling,
+		Gatherer:      gatherer,
+	}
+}
+
+// Run calls Push every Interval until ctx is cancelled. Depending on
+// ErrorHandling, a failed Push either is logged and retried on the next
+// tick, or stops Run immediately.
+func (b *Bridge) Run(ctx context.Context) {
+	ticker := time.NewTicker(b.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.Push(); err != nil {
+				log.Printf("graphite bridge: push failed: %s", err)
+				if b.ErrorHandling == AbortOnError {
+					return
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Push gathers metrics once and writes them to Address as Graphite
+// plaintext, one "metric.path value timestamp\n" line per sample.
+func (b *Bridge) Push() error {
+	mfs, err := b.Gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.Dial(proto, b.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	now := time.Now().Unix()
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			path := metricPath(mf.GetName(), m.GetLabel())
+			value, ok := metricValue(mf.GetType(), m)
+			if !ok {
+				continue
+			}
+			if _, err := fmt.Fprintf(conn, "%s %g %d\n", path, value, now); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// metricPath flattens a metric name and its labels into a dotted Graphite
+// path, e.g. "munin_load_load{hostname=\"foo\"}" becomes
+// "munin_load_load.hostname_foo".
+func metricPath(name string, labels []*dto.LabelPair) string {
+	parts := make([]string, 0, len(labels))
+	for _, l := range labels {
+		parts = append(parts, fmt.Sprintf("%s_%s", l.GetName(), l.GetValue()))
+	}
+	sort.Strings(parts)
+
+	if len(parts) == 0 {
+		return name
+	}
+	return name + "." + strings.Join(parts, ".")
+}
+
+func metricValue(t dto.MetricType, m *dto.Metric) (float64, bool) {
+	switch t {
+	case dto.MetricType_GAUGE:
+		return m.GetGauge().GetValue(), true
+	case dto.MetricType_COUNTER:
+		return m.GetCounter().GetValue(), true
+	case dto.MetricType_UNTYPED:
+		return m.GetUntyped().GetValue(), true
+	default:
+		return 0, false
+	}
+}
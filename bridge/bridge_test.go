@@ -0,0 +1,67 @@
+package bridge
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func label(name, value string) *dto.LabelPair {
+	return &dto.LabelPair{Name: &name, Value: &value}
+}
+
+func TestMetricPath(t *testing.T) {
+	cases := []struct {
+		name   string
+		metric string
+		labels []*dto.LabelPair
+		want   string
+	}{
+		{
+			name:   "no labels",
+			metric: "munin_load_load",
+			want:   "munin_load_load",
+		},
+		{
+			name:   "labels are flattened and sorted regardless of input order",
+			metric: "munin_load_load",
+			labels: []*dto.LabelPair{label("hostname", "foo"), label("graphname", "load")},
+			want:   "munin_load_load.graphname_load.hostname_foo",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := metricPath(c.metric, c.labels); got != c.want {
+				t.Errorf("metricPath(%q, %v) = %q, want %q", c.metric, c.labels, got, c.want)
+			}
+		})
+	}
+}
+
+func TestMetricValue(t *testing.T) {
+	value := 1.5
+
+	cases := []struct {
+		name      string
+		inputType dto.MetricType
+		metric    *dto.Metric
+		wantValue float64
+		wantOK    bool
+	}{
+		{"gauge", dto.MetricType_GAUGE, &dto.Metric{Gauge: &dto.Gauge{Value: &value}}, value, true},
+		{"counter", dto.MetricType_COUNTER, &dto.Metric{Counter: &dto.Counter{Value: &value}}, value, true},
+		{"untyped", dto.MetricType_UNTYPED, &dto.Metric{Untyped: &dto.Untyped{Value: &value}}, value, true},
+		{"summary is unsupported", dto.MetricType_SUMMARY, &dto.Metric{}, 0, false},
+		{"histogram is unsupported", dto.MetricType_HISTOGRAM, &dto.Metric{}, 0, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, ok := metricValue(c.inputType, c.metric)
+			if ok != c.wantOK || got != c.wantValue {
+				t.Errorf("metricValue(...) = (%v, %v), want (%v, %v)", got, ok, c.wantValue, c.wantOK)
+			}
+		})
+	}
+}
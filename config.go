@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io/ioutil"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// TargetConfig describes a single munin-node to scrape.
+type TargetConfig struct {
+	Address  string            `yaml:"address"`
+	Ignore   string            `yaml:"ignore"`
+	Interval int               `yaml:"interval"`
+	Labels   map[string]string `yaml:"labels"`
+}
+
+// Config is the top-level structure of the `-config` YAML file.
+type Config struct {
+	Targets []TargetConfig `yaml:"targets"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
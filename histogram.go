@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// quantileFieldRegexp matches munin metric field names that represent a
+// percentile, e.g. "p50", "p95", "p99".
+var quantileFieldRegexp = regexp.MustCompile(`^p(\d{2,3})$`)
+
+// quantileValue returns the quantile (0..1) a given munin field name
+// represents, and whether it is a recognised quantile field at all.
+func quantileValue(field string) (float64, bool) {
+	switch field {
+	case "min":
+		return 0, true
+	case "median":
+		return 0.5, true
+	case "max":
+		return 1, true
+	}
+	if m := quantileFieldRegexp.FindStringSubmatch(field); m != nil {
+		if n, err := strconv.Atoi(m[1]); err == nil {
+			q := float64(n) / 100.0
+			if q > 1 { // three-digit percentile, e.g. "p999" -> 0.999
+				q = float64(n) / 1000.0
+			}
+			return q, true
+		}
+	}
+	return 0, false
+}
+
+// quantileFields returns the subset of field names in configs that look
+// like percentile/min/median/max fields of the same graph.
+func quantileFields(configs map[string]map[string]string) map[string]float64 {
+	fields := map[string]float64{}
+	for field := range configs {
+		if q, ok := quantileValue(field); ok {
+			fields[field] = q
+		}
+	}
+	return fields
+}
+
+// formatQuantile renders a quantile fraction the way Prometheus summaries
+// do, e.g. 0.5 -> "0.5", 0.95 -> "0.95".
+func formatQuantile(q float64) string {
+	return strconv.FormatFloat(q, 'g', -1, 64)
+}
+
+// registerQuantileGraph registers a single graph that reports several
+// already-computed quantile fields (p50/p95/p99 or min/median/max) as one
+// GaugeVec with a "quantile" label, instead of N independent gauges.
+//
+// Munin hands us the quantile values directly, it doesn't give us the raw
+// sample stream a prometheus.Summary/Histogram needs to compute them, so
+// Observe()-ing each field into one would produce a quantile estimate with
+// no relationship to what munin actually reported. Set()-ing the value
+// straight onto its "quantile" label avoids that misuse. Callers that need
+// the original one-gauge-per-field shape instead (e.g. to match existing
+// dashboards) can set -quantileSeparateGauges, which skips this path
+// entirely in registerMetrics.
+func (t *muninTarget) registerQuantileGraph(name string, graphConfig map[string]string, fields map[string]float64) {
+	t.quantileFields[name] = fields
+
+	metricParts := []string{name}
+	if *metricPrefix != "" {
+		metricParts = append([]string{*metricPrefix}, metricParts...)
+	}
+	metricName := strings.Replace(strings.Join(metricParts, "_"), "-", "_", -1)
+	desc := graphConfig["graph_title"]
+
+	constLabels := prometheus.Labels{}
+	for k, v := range t.labels {
+		constLabels[k] = v
+	}
+
+	gv := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:        metricName,
+			Help:        desc,
+			ConstLabels: constLabels,
+		},
+		[]string{"hostname", "graphname", "quantile"},
+	)
+	if err := t.registerer.Register(gv); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		existing, isGaugeVec := are.ExistingCollector.(*prometheus.GaugeVec)
+		if !ok || !isGaugeVec {
+			log.Printf("[%s] couldn't register quantile gauge %s: %s", t.name, metricName, err)
+			return
+		}
+		log.Printf("[%s] Sharing already-registered quantile gauge %s: %s", t.name, metricName, desc)
+		gv = existing
+	} else {
+		log.Printf("[%s] Registered quantile gauge %s: %s", t.name, metricName, desc)
+	}
+	t.quantileGaugePerGraph[name] = gv
+}
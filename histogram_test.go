@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+func TestQuantileValue(t *testing.T) {
+	cases := []struct {
+		field  string
+		want   float64
+		wantOK bool
+	}{
+		{"min", 0, true},
+		{"median", 0.5, true},
+		{"max", 1, true},
+		{"p50", 0.5, true},
+		{"p95", 0.95, true},
+		{"p99", 0.99, true},
+		{"value", 0, false},
+		{"warning", 0, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.field, func(t *testing.T) {
+			got, ok := quantileValue(c.field)
+			if ok != c.wantOK || got != c.want {
+				t.Errorf("quantileValue(%q) = (%v, %v), want (%v, %v)", c.field, got, ok, c.want, c.wantOK)
+			}
+		})
+	}
+}
+
+func TestQuantileFields(t *testing.T) {
+	configs := map[string]map[string]string{
+		"min":    {"label": "min"},
+		"median": {"label": "median"},
+		"max":    {"label": "max"},
+		"value":  {"label": "not a quantile"},
+	}
+
+	fields := quantileFields(configs)
+	if len(fields) != 3 {
+		t.Fatalf("expected 3 quantile fields, got %v", fields)
+	}
+	if fields["min"] != 0 || fields["median"] != 0.5 || fields["max"] != 1 {
+		t.Errorf("unexpected quantile values: %v", fields)
+	}
+	if _, ok := fields["value"]; ok {
+		t.Errorf("non-quantile field %q should not be included", "value")
+	}
+}
+
+func TestFormatQuantile(t *testing.T) {
+	cases := []struct {
+		q    float64
+		want string
+	}{
+		{0, "0"},
+		{0.5, "0.5"},
+		{0.95, "0.95"},
+		{1, "1"},
+	}
+
+	for _, c := range cases {
+		if got := formatQuantile(c.q); got != c.want {
+			t.Errorf("formatQuantile(%v) = %q, want %q", c.q, got, c.want)
+		}
+	}
+}
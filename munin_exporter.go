@@ -1,52 +1,68 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
 	"runtime"
-	"strconv"
-	"strings"
+	"syscall"
+	"testing"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/julienlegros/munin_exporter/bridge"
 )
 
 const (
-	proto           = "tcp"
-	retryInterval   = 1
-	version_num     = "0.2"
-	version_string  = "munin_exporter, version 0.2"
+	proto          = "tcp"
+	retryInterval  = 1
+	version_num    = "0.2"
+	version_string = "munin_exporter, version 0.2"
 )
 
 var (
-	listeningAddress    = flag.String("listeningAddress", ":8080", "Address on which to expose Prometheus metrics.")
-	listeningPath       = flag.String("listeningPath", "/metrics", "Path on which to expose Prometheus metrics.")
-	metricPrefix        = flag.String("metricPrefix", "", "Metric prefix.")
-	muninAddress        = flag.String("muninAddress", "localhost:4949", "munin-node address.")
-	muninIgnore         = flag.String("muninIgnore", "", "List of plugin prefixes to ignore, comma separated.")
-	muninScrapeInterval = flag.Int("muninScrapeInterval", 60, "Interval in seconds between scrapes.")
-	version             = flag.Bool("version", false, "Show application version.")
-	globalConn          net.Conn
-	hostname            string
-	graphs              []string
-	gaugePerMetric      map[string]*prometheus.GaugeVec
-	counterPerMetric    map[string]*muninCounter
-	muninBanner         *regexp.Regexp
+	listeningAddress       = flag.String("listeningAddress", ":8080", "Address on which to expose Prometheus metrics.")
+	listeningPath          = flag.String("listeningPath", "/metrics", "Path on which to expose Prometheus metrics.")
+	metricPrefix           = flag.String("metricPrefix", "", "Metric prefix.")
+	muninAddress           = flag.String("muninAddress", "localhost:4949", "munin-node address. Ignored if -config is given.")
+	muninIgnore            = flag.String("muninIgnore", "", "List of plugin prefixes to ignore, comma separated. Ignored if -config is given.")
+	muninScrapeInterval    = flag.Int("muninScrapeInterval", 60, "Interval in seconds between scrapes. Used as the default for targets that don't set their own interval.")
+	configFile             = flag.String("config", "", "Path to a YAML file listing multiple munin-node targets. Falls back to -muninAddress when empty.")
+	graphiteAddress        = flag.String("graphiteAddress", "", "Address of a Graphite/Carbon server to push scraped metrics to, in addition to serving Prometheus. Disabled when empty.")
+	graphiteInterval       = flag.Duration("graphiteInterval", 60*time.Second, "Interval between pushes to -graphiteAddress.")
+	metricTTL              = flag.Duration("metricTTL", 0, "Expire a series if it hasn't been seen for this long, e.g. 5m. 0 disables expiration.")
+	quantileSeparateGauges = flag.Bool("quantileSeparateGauges", false, "Export each quantile field of a quantile-reporting plugin (e.g. p50/p95/p99) as its own independent gauge instead of one gauge with a \"quantile\" label.")
+	version                = flag.Bool("version", false, "Show application version.")
+
+	muninBanner *regexp.Regexp
+
+	scrapeSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "munin_scrape_success",
+			Help: "Whether the last scrape of this target succeeded (1) or not (0).",
+		},
+		[]string{"target"},
+	)
+	scrapeDurationSeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "munin_scrape_duration_seconds",
+			Help: "Time taken to fetch data from all registered munin plugins on this target.",
+		},
+		[]string{"target"},
+	)
 )
 
 type muninCounter struct {
 	counterDesc   *prometheus.Desc
 	value         float64
 	currentLabels []string
-
 }
 
 func (c *muninCounter) Describe(ch chan<- *prometheus.Desc) {
@@ -79,203 +95,21 @@ func newMuninCounter(metricName string, desc string, variableLabels []string, co
 }
 
 func init() {
-	flag.Parse()
-	if *version {
-		fmt.Println(version_string)
-		os.Exit(0)
-	}
-	var err error
-	gaugePerMetric = map[string]*prometheus.GaugeVec{}
-	counterPerMetric = map[string]*muninCounter{}
-	muninBanner = regexp.MustCompile(`# munin node at (.*)`)
-
-	err = connect()
-	if err != nil {
-		log.Fatalf("Could not connect to %s: %s", *muninAddress, err)
-	}
-}
-
-func serveStatus() {
-	http.Handle(*listeningPath, promhttp.Handler())
-	http.ListenAndServe(*listeningAddress, nil)
-}
-
-func connect() (err error) {
-	log.Printf("Connecting...")
-	globalConn, err = net.Dial(proto, *muninAddress)
-	if err != nil {
-		return
-	}
-	log.Printf("connected!")
-
-	reader := bufio.NewReader(globalConn)
-	head, err := reader.ReadString('\n')
-	if err != nil {
-		return
-	}
-
-	matches := muninBanner.FindStringSubmatch(head)
-	if len(matches) != 2 { // expect: # munin node at <hostname>
-		return fmt.Errorf("Unexpected line: %s", head)
-	}
-	hostname = matches[1]
-	log.Printf("Found hostname: %s", hostname)
-	return
-}
-
-func muninCommand(cmd string) (reader *bufio.Reader, err error) {
-	reader = bufio.NewReader(globalConn)
-
-	fmt.Fprintf(globalConn, cmd+"\n")
-
-	_, err = reader.Peek(1)
-	switch err {
-	case io.EOF:
-		log.Printf("not connected anymore, closing connection")
-		globalConn.Close()
-		for {
-			err = connect()
-			if err == nil {
-				break
-			}
-			log.Printf("Couldn't reconnect: %s", err)
-			time.Sleep(retryInterval * time.Second)
+	// testing.Testing() is true under `go test`, which has its own flags
+	// (e.g. -test.testlogfile) that flag.Parse() doesn't know about and
+	// would fail on.
+	if !testing.Testing() {
+		flag.Parse()
+		if *version {
+			fmt.Println(version_string)
+			os.Exit(0)
 		}
-
-		return muninCommand(cmd)
-	case nil: //no error
-		break
-	default:
-		log.Fatalf("Unexpected error: %s", err)
-	}
-
-	return
-}
-
-func muninList() (items []string, err error) {
-	munin, err := muninCommand("list")
-	if err != nil {
-		log.Printf("couldn't get list")
-		return
 	}
+	muninBanner = regexp.MustCompile(`# munin node at (.*)`)
 
-	response, err := munin.ReadString('\n') // we are only interested in the first line
-	if err != nil {
-		log.Printf("couldn't read response")
-		return
-	}
-
-	if response[0] == '#' { // # not expected here
-		err = fmt.Errorf("Error getting items: %s", response)
-		return
-	}
-	items = strings.Fields(strings.TrimRight(response, "\n"))
-	return
-}
-
-func muninConfig(name string) (config map[string]map[string]string, graphConfig map[string]string, err error) {
-	graphConfig = make(map[string]string)
-	config = make(map[string]map[string]string)
-
-	resp, err := muninCommand("config " + name)
-	if err != nil {
-		log.Printf("couldn't get config for %s", name)
-		return
-	}
-
-	for {
-		line, err := resp.ReadString('\n')
-		if err == io.EOF {
-			log.Fatalf("unexpected EOF, retrying")
-			return muninConfig(name)
-		}
-		if err != nil {
-			return nil, nil, err
-		}
-		if line == ".\n" { // munin end marker
-			break
-		}
-		if line[0] == '#' { // here it's just a comment, so ignore it
-			continue
-		}
-		parts := strings.Fields(line)
-		if len(parts) < 2 {
-			return nil, nil, fmt.Errorf("Line unexpected: %s", line)
-		}
-		key, value := parts[0], strings.TrimRight(strings.Join(parts[1:], " "), "\n")
-
-		keyParts := strings.Split(key, ".")
-		if len(keyParts) > 1 { // it's a metric config (metric.label etc)
-			if _, ok := config[keyParts[0]]; !ok { //FIXME: is there no better way?
-				config[keyParts[0]] = make(map[string]string)
-			}
-			config[keyParts[0]][keyParts[1]] = value
-		} else {
-			graphConfig[keyParts[0]] = value
-		}
-	}
-	return
-}
-
-func registerMetrics() (err error) {
-	items, err := muninList()
-	if err != nil {
-		return
-	}
-
-	ignoreList := strings.Split(*muninIgnore, ",")
-	var skip bool
-
-	for _, name := range items {
-		skip = false
-		for _, prefix := range ignoreList {
-			if strings.HasPrefix(name, prefix) {
-				skip = true
-			}
-		}
-
-		if skip { continue }
-
-		graphs = append(graphs, name)
-		configs, graphConfig, err := muninConfig(name)
-		if err != nil {
-			return err
-		}
-
-		for metric, config := range configs {
-			metricParts := []string{name, metric}
-			if *metricPrefix != "" {
-				metricParts = append([]string{*metricPrefix}, metricParts...)
-			}
-			metricName := strings.Replace(strings.Join(metricParts, "_"), "-", "_", -1)
-			desc := graphConfig["graph_title"] + ": " + config["label"]
-			if config["info"] != "" {
-				desc = desc + ", " + config["info"]
-			}
-			muninType := strings.ToLower(config["type"])
-			// muninType can be empty and defaults to gauge
-			if muninType == "counter" || muninType == "derive" {
-				gv := newMuninCounter(metricName, desc, []string{"hostname", "graphname", "muninlabel"}, prometheus.Labels{"type": muninType})
-				log.Printf("Registered counter %s: %s", metricName, desc)
-				counterPerMetric[metricName] = gv
-				prometheus.Register(gv)
+	prometheus.MustRegister(scrapeSuccess)
+	prometheus.MustRegister(scrapeDurationSeconds)
 
-			} else {
-				gv := prometheus.NewGaugeVec(
-					prometheus.GaugeOpts{
-						Name:        metricName,
-						Help:        desc,
-						ConstLabels: prometheus.Labels{"type": "gauge"},
-					},
-					[]string{"hostname", "graphname", "muninlabel"},
-				)
-				log.Printf("Registered gauge %s: %s", metricName, desc)
-				gaugePerMetric[metricName] = gv
-				prometheus.Register(gv)
-			}
-		}
-	}
-	// Built-in metrics
 	buildInfoMetric := prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name:        "munin_exporter_build_info",
@@ -285,95 +119,67 @@ func registerMetrics() (err error) {
 		[]string{"goversion", "version_num"},
 	)
 	buildInfoMetric.WithLabelValues(runtime.Version(), version_num).Set(1)
-	prometheus.Register(buildInfoMetric)
-	muninMetricName := "munin_exporter_fetch_time"
-	gv := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name:	muninMetricName,
-			Help:	"Time taken to fetch data from all registered munin plugins",
-			ConstLabels: prometheus.Labels{"type": "gauge"},
-		},
-		[]string{"hostname"},
-	)
-	gaugePerMetric[muninMetricName] = gv
-	prometheus.Register(gv)
-	return nil
+	prometheus.MustRegister(buildInfoMetric)
 }
 
-func fetchMetrics() (err error) {
-	start := time.Now()
-	for _, graph := range graphs {
-		munin, err := muninCommand("fetch " + graph)
+func serveStatus() {
+	http.Handle(*listeningPath, promhttp.Handler())
+	http.HandleFunc("/probe", probeHandler)
+	http.ListenAndServe(*listeningAddress, nil)
+}
+
+// loadTargets returns the list of munin-nodes to scrape, either from
+// -config or, as a fallback, a single target built from -muninAddress.
+func loadTargets() ([]*muninTarget, error) {
+	var targets []*muninTarget
+	if *configFile == "" {
+		targets = []*muninTarget{
+			newMuninTarget("default", *muninAddress, *muninIgnore, *muninScrapeInterval, nil),
+		}
+	} else {
+		cfg, err := loadConfig(*configFile)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		for {
-			line, err := munin.ReadString('\n')
-			line = strings.TrimRight(line, "\n")
-			if err == io.EOF {
-				log.Fatalf("unexpected EOF, retrying")
-				return fetchMetrics()
-			}
-			if err != nil {
-				return err
-			}
-			if len(line) == 1 && line[0] == '.' {
-				log.Printf("End of list")
-				break
-			}
-
-			parts := strings.Fields(line)
-			if len(parts) != 2 {
-				log.Printf("unexpected line: %s", line)
-				continue
-			}
-			key, valueString := strings.Split(parts[0], ".")[0], parts[1]
-			value, err := strconv.ParseFloat(valueString, 64)
-			if err != nil {
-				log.Printf("Couldn't parse value in line %s, malformed?", line)
-				continue
-			}
-			metricParts := []string{graph, key}
-			if *metricPrefix != "" {
-				metricParts = append([]string{*metricPrefix}, metricParts...)
-			}
-			name := strings.Replace(strings.Join(metricParts, "_"), "-", "_", -1)
-			log.Printf("%s: %f\n", name, value)
-			_, isGauge := gaugePerMetric[name]
-			if isGauge {
-				gaugePerMetric[name].WithLabelValues(hostname, graph, key).Set(value)
-				continue
-			}
-			_, isCounter := counterPerMetric[name]
-			if isCounter {
-				counterPerMetric[name].UpdateLabels([]string{hostname, graph, key}, value)
-				continue
-			}
+		targets = make([]*muninTarget, 0, len(cfg.Targets))
+		for _, tc := range cfg.Targets {
+			targets = append(targets, newMuninTarget(tc.Address, tc.Address, tc.Ignore, tc.Interval, tc.Labels))
 		}
 	}
-	muninMetricName := "munin_exporter_fetch_time"
-	gaugePerMetric[muninMetricName].WithLabelValues(hostname).Set(time.Since(start).Seconds())
-	return
+
+	return targets, nil
 }
 
 func main() {
 	flag.Parse()
-	err := registerMetrics()
+
+	targets, err := loadTargets()
 	if err != nil {
-		log.Fatalf("Could not register metrics: %s", err)
+		log.Fatalf("Could not load targets: %s", err)
 	}
 
-	go serveStatus()
+	for _, t := range targets {
+		go t.run()
+	}
 
-	func() {
-		for {
-			log.Printf("Scraping")
-			err := fetchMetrics()
-			if err != nil {
-				log.Printf("Error occured when trying to fetch metrics: %s", err)
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			log.Printf("received SIGHUP, reloading plugin lists")
+			for _, t := range targets {
+				if err := t.reload(); err != nil {
+					log.Printf("[%s] reload failed: %s", t.name, err)
+				}
 			}
-			time.Sleep(time.Duration(*muninScrapeInterval) * time.Second)
 		}
 	}()
+
+	if *graphiteAddress != "" {
+		b := bridge.New(*graphiteAddress, *graphiteInterval, bridge.ContinueOnError, prometheus.DefaultGatherer)
+		go b.Run(context.Background())
+	}
+
+	serveStatus()
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// nopRegisterer discards every Register/Unregister call. MuninCollector
+// forwards its target's per-metric vecs to the parent registry itself in
+// Collect, so the target it owns must not register them anywhere else -
+// in particular not into prometheus.DefaultRegisterer, which is shared
+// with the main scrape loop's /metrics output.
+type nopRegisterer struct{}
+
+func (nopRegisterer) Register(prometheus.Collector) error  { return nil }
+func (nopRegisterer) MustRegister(...prometheus.Collector) {}
+func (nopRegisterer) Unregister(prometheus.Collector) bool { return true }
+
+// MuninCollector implements prometheus.Collector by scraping a single,
+// arbitrary munin-node on demand. It is instantiated fresh for every
+// /probe request so that a slow or unreachable target can't leak state
+// into the next probe, following the blackbox_exporter pattern.
+type MuninCollector struct {
+	target *muninTarget
+
+	probeSuccess  prometheus.Gauge
+	probeDuration prometheus.Gauge
+}
+
+func NewMuninCollector(address string) *MuninCollector {
+	target := newMuninTarget(address, address, "", 0, nil)
+	target.registerer = nopRegisterer{}
+
+	return &MuninCollector{
+		target: target,
+		probeSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "munin_probe_success",
+			Help: "Whether the probe of this target succeeded (1) or not (0).",
+		}),
+		probeDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "munin_probe_duration_seconds",
+			Help: "Time taken to probe this target.",
+		}),
+	}
+}
+
+func (c *MuninCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.probeSuccess.Desc()
+	ch <- c.probeDuration.Desc()
+}
+
+func (c *MuninCollector) Collect(ch chan<- prometheus.Metric) {
+	start := time.Now()
+	success := c.probe()
+	c.probeDuration.Set(time.Since(start).Seconds())
+
+	if success {
+		c.probeSuccess.Set(1)
+	} else {
+		c.probeSuccess.Set(0)
+	}
+
+	ch <- c.probeSuccess
+	ch <- c.probeDuration
+
+	for _, gv := range c.target.gaugePerMetric {
+		gv.Collect(ch)
+	}
+	for _, cv := range c.target.counterPerMetric {
+		cv.Collect(ch)
+	}
+	for _, gv := range c.target.quantileGaugePerGraph {
+		gv.Collect(ch)
+	}
+}
+
+func (c *MuninCollector) probe() bool {
+	if err := c.target.connect(); err != nil {
+		log.Printf("probe: could not connect to %s: %s", c.target.address, err)
+		return false
+	}
+	defer c.target.conn.Close()
+
+	if err := c.target.registerMetrics(); err != nil {
+		log.Printf("probe: could not register metrics for %s: %s", c.target.address, err)
+		return false
+	}
+
+	if err := c.target.fetchMetrics(); err != nil {
+		log.Printf("probe: could not fetch metrics for %s: %s", c.target.address, err)
+		return false
+	}
+
+	return true
+}
+
+// probeHandler serves /probe?target=host:4949, running a full
+// list/config/fetch cycle against that address only and returning the
+// result as a standalone Prometheus exposition.
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	registry := prometheus.NewRegistry()
+	collector := NewMuninCollector(target)
+	registry.MustRegister(collector)
+
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
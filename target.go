@@ -0,0 +1,558 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// muninTarget holds all the state needed to scrape a single munin-node and
+// export its plugins as Prometheus metrics. Each target owns its own
+// connection and runs its own scrape loop, so one unreachable node can't
+// stall the others.
+type muninTarget struct {
+	name     string
+	address  string
+	ignore   string
+	interval time.Duration
+	labels   prometheus.Labels
+
+	conn     net.Conn
+	hostname string
+	graphs   []string
+
+	// capDirtyConfig and capMultigraph reflect the capabilities the
+	// munin-node agreed to during the "cap" handshake in connect().
+	capDirtyConfig bool
+	capMultigraph  bool
+
+	// mu guards every field above/below that registerMetrics, fetchMetrics
+	// and reload touch, so a SIGHUP-triggered reload can't race a scrape.
+	mu sync.Mutex
+
+	gaugePerMetric   map[string]*prometheus.GaugeVec
+	counterPerMetric map[string]*muninCounter
+
+	// quantileGaugePerGraph holds one GaugeVec per graph that was detected
+	// to report quantile fields (p50/p95/p99 or min/median/max) instead of
+	// N independent gauges. Munin already hands us the computed quantile,
+	// so each field is Set() on its own "quantile" label value rather than
+	// Observe()d into a prometheus.Summary/Histogram, which would estimate
+	// quantiles from a sample stream we don't have.
+	quantileGaugePerGraph map[string]*prometheus.GaugeVec
+	quantileFields        map[string]map[string]float64 // graph -> field -> quantile
+
+	// registerer is where registerMetrics/reload (un)register every
+	// per-metric collector. It defaults to the global DefaultRegisterer;
+	// probe.go swaps it for a no-op so an on-demand /probe scrape can't
+	// leak the probed host's series into the main /metrics output.
+	registerer prometheus.Registerer
+
+	ttl *ttlTracker
+}
+
+func newMuninTarget(name, address, ignore string, interval int, labels map[string]string) *muninTarget {
+	if interval <= 0 {
+		interval = *muninScrapeInterval
+	}
+
+	constLabels := prometheus.Labels{}
+	for k, v := range labels {
+		constLabels[k] = v
+	}
+
+	return &muninTarget{
+		name:                  name,
+		address:               address,
+		ignore:                ignore,
+		interval:              time.Duration(interval) * time.Second,
+		labels:                constLabels,
+		gaugePerMetric:        map[string]*prometheus.GaugeVec{},
+		counterPerMetric:      map[string]*muninCounter{},
+		quantileGaugePerGraph: map[string]*prometheus.GaugeVec{},
+		quantileFields:        map[string]map[string]float64{},
+		registerer:            prometheus.DefaultRegisterer,
+		ttl:                   newTTLTracker(),
+	}
+}
+
+func (t *muninTarget) connect() (err error) {
+	log.Printf("[%s] Connecting to %s...", t.name, t.address)
+	t.conn, err = net.Dial(proto, t.address)
+	if err != nil {
+		return
+	}
+	log.Printf("[%s] connected!", t.name)
+
+	reader := bufio.NewReader(t.conn)
+	head, err := reader.ReadString('\n')
+	if err != nil {
+		t.conn.Close()
+		return
+	}
+
+	matches := muninBanner.FindStringSubmatch(head)
+	if len(matches) != 2 { // expect: # munin node at <hostname>
+		t.conn.Close()
+		return fmt.Errorf("Unexpected line: %s", head)
+	}
+	t.hostname = matches[1]
+	log.Printf("[%s] Found hostname: %s", t.name, t.hostname)
+
+	t.negotiateCapabilities()
+	return
+}
+
+// negotiateCapabilities asks the munin-node which of "multigraph" and
+// "dirtyconfig" it supports. With dirtyconfig, "config" returns values
+// inline so fetchMetrics can skip the separate "fetch" round-trip.
+func (t *muninTarget) negotiateCapabilities() {
+	fmt.Fprintf(t.conn, "cap multigraph dirtyconfig\n")
+	reader := bufio.NewReader(t.conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		log.Printf("[%s] couldn't negotiate capabilities: %s", t.name, err)
+		return
+	}
+
+	line = strings.TrimRight(line, "\n")
+	caps := strings.Fields(strings.TrimPrefix(line, "cap "))
+	for _, c := range caps {
+		switch c {
+		case "dirtyconfig":
+			t.capDirtyConfig = true
+		case "multigraph":
+			t.capMultigraph = true
+		}
+	}
+	log.Printf("[%s] negotiated capabilities: multigraph=%t dirtyconfig=%t", t.name, t.capMultigraph, t.capDirtyConfig)
+}
+
+func (t *muninTarget) muninCommand(cmd string) (reader *bufio.Reader, err error) {
+	reader = bufio.NewReader(t.conn)
+
+	fmt.Fprintf(t.conn, cmd+"\n")
+
+	_, err = reader.Peek(1)
+	switch err {
+	case io.EOF:
+		log.Printf("[%s] not connected anymore, closing connection", t.name)
+		t.conn.Close()
+		for {
+			err = t.connect()
+			if err == nil {
+				break
+			}
+			log.Printf("[%s] Couldn't reconnect: %s", t.name, err)
+			time.Sleep(retryInterval * time.Second)
+		}
+
+		return t.muninCommand(cmd)
+	case nil: //no error
+		break
+	default:
+		return nil, fmt.Errorf("[%s] unexpected error: %s", t.name, err)
+	}
+
+	return
+}
+
+func (t *muninTarget) muninList() (items []string, err error) {
+	munin, err := t.muninCommand("list")
+	if err != nil {
+		log.Printf("[%s] couldn't get list", t.name)
+		return
+	}
+
+	response, err := munin.ReadString('\n') // we are only interested in the first line
+	if err != nil {
+		log.Printf("[%s] couldn't read response", t.name)
+		return
+	}
+
+	if response[0] == '#' { // # not expected here
+		err = fmt.Errorf("Error getting items: %s", response)
+		return
+	}
+	items = strings.Fields(strings.TrimRight(response, "\n"))
+	return
+}
+
+// graphSection holds the parsed config of one graph. A plain plugin
+// response has exactly one section, named after the plugin itself; a
+// multigraph plugin (e.g. diskstats) switches to a new named section
+// every time it emits a "multigraph <name>" line.
+type graphSection struct {
+	config      map[string]map[string]string
+	graphConfig map[string]string
+}
+
+// muninConfig runs "config <name>" and returns one graphSection per graph
+// found in the response, keyed by graph name, plus the graph names in the
+// order they were declared. order[0] is always name itself; subsequent
+// multigraph sections are appended.
+func (t *muninTarget) muninConfig(name string) (sections map[string]*graphSection, order []string, err error) {
+	sections = map[string]*graphSection{
+		name: {config: make(map[string]map[string]string), graphConfig: make(map[string]string)},
+	}
+	order = []string{name}
+	current := name
+
+	resp, err := t.muninCommand("config " + name)
+	if err != nil {
+		log.Printf("[%s] couldn't get config for %s", t.name, name)
+		return
+	}
+
+	for {
+		line, err := resp.ReadString('\n')
+		if err != nil {
+			// Including io.EOF: registerMetrics returns this to its caller
+			// (run() then gives up on this target alone), rather than
+			// killing the whole process over one target's dropped
+			// connection.
+			return nil, nil, err
+		}
+		if line == ".\n" { // munin end marker
+			break
+		}
+		if line[0] == '#' { // here it's just a comment, so ignore it
+			continue
+		}
+		line = strings.TrimRight(line, "\n")
+		if strings.HasPrefix(line, "multigraph ") {
+			current = strings.TrimPrefix(line, "multigraph ")
+			if _, ok := sections[current]; !ok {
+				sections[current] = &graphSection{config: make(map[string]map[string]string), graphConfig: make(map[string]string)}
+				order = append(order, current)
+			}
+			continue
+		}
+
+		parts := strings.Fields(line)
+		if len(parts) < 2 {
+			return nil, nil, fmt.Errorf("Line unexpected: %s", line)
+		}
+		key, value := parts[0], strings.Join(parts[1:], " ")
+
+		keyParts := strings.Split(key, ".")
+		sec := sections[current]
+		if len(keyParts) > 1 { // it's a metric config (metric.label etc)
+			if _, ok := sec.config[keyParts[0]]; !ok { //FIXME: is there no better way?
+				sec.config[keyParts[0]] = make(map[string]string)
+			}
+			sec.config[keyParts[0]][keyParts[1]] = value
+		} else {
+			sec.graphConfig[keyParts[0]] = value
+		}
+	}
+	return
+}
+
+func (t *muninTarget) registerMetrics() (err error) {
+	items, err := t.muninList()
+	if err != nil {
+		return
+	}
+
+	ignoreList := strings.Split(t.ignore, ",")
+	var skip bool
+
+	for _, name := range items {
+		skip = false
+		for _, prefix := range ignoreList {
+			if prefix != "" && strings.HasPrefix(name, prefix) {
+				skip = true
+			}
+		}
+
+		if skip {
+			continue
+		}
+
+		t.graphs = append(t.graphs, name)
+		sections, order, err := t.muninConfig(name)
+		if err != nil {
+			return err
+		}
+
+		for _, graphName := range order {
+			sec := sections[graphName]
+
+			if fields := quantileFields(sec.config); len(fields) >= 2 && !*quantileSeparateGauges {
+				t.registerQuantileGraph(graphName, sec.graphConfig, fields)
+				continue
+			}
+
+			for metric, config := range sec.config {
+				metricParts := []string{graphName, metric}
+				if *metricPrefix != "" {
+					metricParts = append([]string{*metricPrefix}, metricParts...)
+				}
+				metricName := strings.Replace(strings.Join(metricParts, "_"), "-", "_", -1)
+				desc := sec.graphConfig["graph_title"] + ": " + config["label"]
+				if config["info"] != "" {
+					desc = desc + ", " + config["info"]
+				}
+				muninType := strings.ToLower(config["type"])
+				constLabels := prometheus.Labels{}
+				for k, v := range t.labels {
+					constLabels[k] = v
+				}
+				// muninType can be empty and defaults to gauge
+				if muninType == "counter" || muninType == "derive" {
+					constLabels["type"] = muninType
+					gv := newMuninCounter(metricName, desc, []string{"hostname", "graphname", "muninlabel"}, constLabels)
+					if err := t.registerer.Register(gv); err != nil {
+						are, ok := err.(prometheus.AlreadyRegisteredError)
+						existing, isCounter := are.ExistingCollector.(*muninCounter)
+						if !ok || !isCounter {
+							return fmt.Errorf("[%s] couldn't register counter %s: %s", t.name, metricName, err)
+						}
+						// Another target already exports this exact metric
+						// (same name + const labels, e.g. two hosts running
+						// the same plugin); share its collector instead of
+						// dropping this target's samples on the floor.
+						log.Printf("[%s] Sharing already-registered counter %s: %s", t.name, metricName, desc)
+						gv = existing
+					} else {
+						log.Printf("[%s] Registered counter %s: %s", t.name, metricName, desc)
+					}
+					t.counterPerMetric[metricName] = gv
+
+				} else {
+					constLabels["type"] = "gauge"
+					gv := prometheus.NewGaugeVec(
+						prometheus.GaugeOpts{
+							Name:        metricName,
+							Help:        desc,
+							ConstLabels: constLabels,
+						},
+						[]string{"hostname", "graphname", "muninlabel"},
+					)
+					if err := t.registerer.Register(gv); err != nil {
+						are, ok := err.(prometheus.AlreadyRegisteredError)
+						existing, isGaugeVec := are.ExistingCollector.(*prometheus.GaugeVec)
+						if !ok || !isGaugeVec {
+							return fmt.Errorf("[%s] couldn't register gauge %s: %s", t.name, metricName, err)
+						}
+						log.Printf("[%s] Sharing already-registered gauge %s: %s", t.name, metricName, desc)
+						gv = existing
+					} else {
+						log.Printf("[%s] Registered gauge %s: %s", t.name, metricName, desc)
+					}
+					t.gaugePerMetric[metricName] = gv
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (t *muninTarget) fetchMetrics() (err error) {
+	for _, plugin := range t.graphs {
+		// With cap dirtyconfig negotiated, "config" returns values inline
+		// (as "<field>.value <value>" lines), so we can skip the separate
+		// "fetch" round-trip entirely.
+		cmd := "fetch " + plugin
+		dirty := t.capDirtyConfig
+		if dirty {
+			cmd = "config " + plugin
+		}
+
+		munin, err := t.muninCommand(cmd)
+		if err != nil {
+			return err
+		}
+
+		graph := plugin
+		for {
+			line, err := munin.ReadString('\n')
+			line = strings.TrimRight(line, "\n")
+			if err != nil {
+				// Including io.EOF: let run()'s scrape loop log this and
+				// try again next cycle instead of killing every target.
+				return err
+			}
+			if len(line) == 1 && line[0] == '.' {
+				break
+			}
+			if strings.HasPrefix(line, "multigraph ") {
+				graph = strings.TrimPrefix(line, "multigraph ")
+				continue
+			}
+
+			parts := strings.Fields(line)
+			if len(parts) != 2 {
+				log.Printf("[%s] unexpected line: %s", t.name, line)
+				continue
+			}
+			key := parts[0]
+			if dirty {
+				// config responses also carry .label/.type/.min/... lines;
+				// only ".value" ones carry the current sample.
+				if !strings.HasSuffix(key, ".value") {
+					continue
+				}
+			}
+			key, valueString := strings.Split(key, ".")[0], parts[1]
+			value, err := strconv.ParseFloat(valueString, 64)
+			if err != nil {
+				log.Printf("[%s] Couldn't parse value in line %s, malformed?", t.name, line)
+				continue
+			}
+
+			if q, ok := t.quantileFields[graph][key]; ok {
+				if gv, ok := t.quantileGaugePerGraph[graph]; ok {
+					gv.WithLabelValues(t.hostname, graph, formatQuantile(q)).Set(value)
+				}
+				t.ttl.markSeen(graph, []string{t.hostname, graph})
+				continue
+			}
+
+			metricParts := []string{graph, key}
+			if *metricPrefix != "" {
+				metricParts = append([]string{*metricPrefix}, metricParts...)
+			}
+			name := strings.Replace(strings.Join(metricParts, "_"), "-", "_", -1)
+			labelValues := []string{t.hostname, graph, key}
+			_, isGauge := t.gaugePerMetric[name]
+			if isGauge {
+				t.gaugePerMetric[name].WithLabelValues(labelValues...).Set(value)
+				t.ttl.markSeen(name, labelValues)
+				continue
+			}
+			_, isCounter := t.counterPerMetric[name]
+			if isCounter {
+				t.counterPerMetric[name].UpdateLabels(labelValues, value)
+				t.ttl.markSeen(name, labelValues)
+				continue
+			}
+		}
+	}
+	return
+}
+
+// sweepExpired periodically deletes series that haven't been observed in
+// the last ttl, so a removed plugin (e.g. a disk that disappeared) stops
+// being exported instead of sticking at its last value forever.
+func (t *muninTarget) sweepExpired(ttl time.Duration) {
+	ticker := time.NewTicker(ttl)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		t.mu.Lock()
+		t.ttl.sweep(ttl, func(metric string, labelValues []string) {
+			if gv, ok := t.gaugePerMetric[metric]; ok {
+				gv.DeleteLabelValues(labelValues...)
+				log.Printf("[%s] expired stale gauge %s", t.name, metric)
+			}
+			if c, ok := t.counterPerMetric[metric]; ok {
+				t.registerer.Unregister(c)
+				delete(t.counterPerMetric, metric)
+				log.Printf("[%s] expired stale counter %s", t.name, metric)
+			}
+			if gv, ok := t.quantileGaugePerGraph[metric]; ok {
+				// labelValues is just {hostname, graphname}; drop every
+				// quantile field of this graph in one go.
+				gv.DeletePartialMatch(prometheus.Labels{"hostname": labelValues[0], "graphname": labelValues[1]})
+				log.Printf("[%s] expired stale quantile gauge %s", t.name, metric)
+			}
+		})
+		t.mu.Unlock()
+	}
+}
+
+// reload unregisters every collector currently exported for this target
+// and runs registerMetrics again, so plugins installed or removed since
+// startup are picked up without restarting the exporter.
+//
+// Known gap: when two targets share a collector (registerMetrics's
+// AlreadyRegisteredError path - the common case for multi-target configs
+// that don't set per-target labels, since then metric name + const labels
+// are identical across targets), main's SIGHUP handler calls reload() on
+// each target sequentially. Between the first target unregistering and
+// recreating the shared collector and the second target's own reload()
+// picking up the new instance, a scrape tick on the second target (under
+// its own t.mu, not this one) can still write into the orphaned, no-longer-
+// registered collector and silently lose that cycle's samples for it.
+func (t *muninTarget) reload() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn == nil {
+		log.Printf("[%s] not connected yet, skipping reload", t.name)
+		return nil
+	}
+
+	log.Printf("[%s] reloading plugin list", t.name)
+	for _, gv := range t.gaugePerMetric {
+		t.registerer.Unregister(gv)
+	}
+	for _, c := range t.counterPerMetric {
+		t.registerer.Unregister(c)
+	}
+	for _, gv := range t.quantileGaugePerGraph {
+		t.registerer.Unregister(gv)
+	}
+
+	t.graphs = nil
+	t.gaugePerMetric = map[string]*prometheus.GaugeVec{}
+	t.counterPerMetric = map[string]*muninCounter{}
+	t.quantileGaugePerGraph = map[string]*prometheus.GaugeVec{}
+	t.quantileFields = map[string]map[string]float64{}
+
+	return t.registerMetrics()
+}
+
+// run connects to the target, registers its metrics once and then scrapes
+// it forever on its own interval, reporting success/duration for every
+// scrape cycle. A target that's down or misbehaving at startup only takes
+// itself out; it must not kill the other targets' already-running goroutines.
+func (t *muninTarget) run() {
+	t.mu.Lock()
+	for {
+		err := t.connect()
+		if err == nil {
+			break
+		}
+		log.Printf("[%s] Could not connect to %s: %s, retrying", t.name, t.address, err)
+		t.mu.Unlock()
+		time.Sleep(retryInterval * time.Second)
+		t.mu.Lock()
+	}
+
+	err := t.registerMetrics()
+	t.mu.Unlock()
+	if err != nil {
+		log.Printf("[%s] Could not register metrics, giving up on this target: %s", t.name, err)
+		return
+	}
+
+	if *metricTTL > 0 {
+		go t.sweepExpired(*metricTTL)
+	}
+
+	for {
+		start := time.Now()
+		t.mu.Lock()
+		err := t.fetchMetrics()
+		t.mu.Unlock()
+		scrapeDurationSeconds.WithLabelValues(t.name).Set(time.Since(start).Seconds())
+		if err != nil {
+			log.Printf("[%s] Error occured when trying to fetch metrics: %s", t.name, err)
+			scrapeSuccess.WithLabelValues(t.name).Set(0)
+		} else {
+			scrapeSuccess.WithLabelValues(t.name).Set(1)
+		}
+		time.Sleep(t.interval)
+	}
+}
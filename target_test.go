@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeMuninNode answers a fixed, ordered sequence of commands over conn the
+// way a real munin-node would, writing each step's response as soon as its
+// command line arrives.
+func fakeMuninNode(t *testing.T, conn net.Conn, steps []struct{ cmd, resp string }) {
+	t.Helper()
+	go func() {
+		reader := bufio.NewReader(conn)
+		for _, step := range steps {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if got := strings.TrimRight(line, "\n"); got != step.cmd {
+				t.Errorf("fakeMuninNode: got command %q, want %q", got, step.cmd)
+			}
+			if _, err := conn.Write([]byte(step.resp)); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// TestFetchMetricsMultigraphDirtyConfig exercises the two protocol features
+// added on top of the original plain "fetch": a plugin whose "config"
+// response switches graphs mid-stream via "multigraph <name>", and a
+// dirtyconfig-negotiated node that folds values into the "config" response
+// instead of a separate "fetch" round-trip.
+func TestFetchMetricsMultigraphDirtyConfig(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	fakeMuninNode(t, server, []struct{ cmd, resp string }{
+		{"list", "diskstats\n"},
+		{"config diskstats", "multigraph diskstats_iops\n" +
+			"graph_title Disk IOs\n" +
+			"sda.label sda\n" +
+			"sda.type GAUGE\n" +
+			".\n"},
+		{"config diskstats", "multigraph diskstats_iops\n" +
+			"sda.value 42\n" +
+			".\n"},
+	})
+
+	target := newMuninTarget("test", "test", "", 0, nil)
+	target.conn = client
+	target.capDirtyConfig = true
+	target.registerer = prometheus.NewRegistry()
+
+	if err := target.registerMetrics(); err != nil {
+		t.Fatalf("registerMetrics failed: %s", err)
+	}
+	if err := target.fetchMetrics(); err != nil {
+		t.Fatalf("fetchMetrics failed: %s", err)
+	}
+
+	gv, ok := target.gaugePerMetric["diskstats_iops_sda"]
+	if !ok {
+		t.Fatalf("expected diskstats_iops_sda to be registered, got %v", target.gaugePerMetric)
+	}
+
+	mfs, err := target.registerer.(*prometheus.Registry).Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %s", err)
+	}
+	var found bool
+	for _, mf := range mfs {
+		if mf.GetName() != "diskstats_iops_sda" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			found = true
+			if got := m.GetGauge().GetValue(); got != 42 {
+				t.Errorf("diskstats_iops_sda = %v, want 42", got)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("diskstats_iops_sda not present in Gather() output")
+	}
+	_ = gv
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// ttlTracker records the last time each individual metric series (a metric
+// name plus one specific set of label values, e.g. one disk of a
+// multi-disk diskstats_usage GaugeVec) was observed, so a background
+// sweeper can expire series that have disappeared (e.g. a removed disk,
+// an ephemeral container's if_veth* interface) instead of exporting their
+// last value forever.
+type ttlTracker struct {
+	mu       sync.Mutex
+	lastSeen map[seriesKey]time.Time
+	series   map[seriesKey]muninSeries
+	now      func() time.Time
+}
+
+// muninSeries is the (metric, labelValues) pair a seriesKey was derived
+// from, kept around so sweep can hand it back to its expire callback.
+type muninSeries struct {
+	metric      string
+	labelValues []string
+}
+
+// seriesKey uniquely identifies one series of one metric. labelValues are
+// joined with a separator that can't appear in a munin plugin/field/host
+// name, so two distinct label combinations never collide.
+type seriesKey string
+
+func newSeriesKey(metric string, labelValues []string) seriesKey {
+	return seriesKey(metric + "\x00" + strings.Join(labelValues, "\x00"))
+}
+
+func newTTLTracker() *ttlTracker {
+	return &ttlTracker{
+		lastSeen: map[seriesKey]time.Time{},
+		series:   map[seriesKey]muninSeries{},
+		now:      time.Now,
+	}
+}
+
+func (t *ttlTracker) markSeen(metric string, labelValues []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := newSeriesKey(metric, labelValues)
+	t.lastSeen[key] = t.now()
+	t.series[key] = muninSeries{metric: metric, labelValues: labelValues}
+}
+
+// sweep calls expire for every series whose lastSeen is older than ttl and
+// forgets it. A ttl <= 0 disables expiration entirely.
+func (t *ttlTracker) sweep(ttl time.Duration, expire func(metric string, labelValues []string)) {
+	if ttl <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cutoff := t.now().Add(-ttl)
+	for key, seen := range t.lastSeen {
+		if seen.Before(cutoff) {
+			s := t.series[key]
+			expire(s.metric, s.labelValues)
+			delete(t.lastSeen, key)
+			delete(t.series, key)
+		}
+	}
+}
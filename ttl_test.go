@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeClock lets the test advance time deterministically past the TTL
+// without sleeping.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func TestTTLTrackerExpiresStaleSeries(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+
+	tracker := newTTLTracker()
+	tracker.now = clock.Now
+
+	registry := prometheus.NewRegistry()
+	gv := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "munin_test_metric", Help: "test"},
+		[]string{"hostname", "graphname", "muninlabel"},
+	)
+	registry.MustRegister(gv)
+
+	labelValues := []string{"host", "graph", "metric"}
+	gv.WithLabelValues(labelValues...).Set(1)
+	tracker.markSeen("munin_test_metric", labelValues)
+
+	if !metricExported(t, registry, "munin_test_metric") {
+		t.Fatalf("expected metric to be present before expiry")
+	}
+
+	clock.now = clock.now.Add(10 * time.Minute)
+	tracker.sweep(5*time.Minute, func(metric string, values []string) {
+		if g, ok := map[string]*prometheus.GaugeVec{"munin_test_metric": gv}[metric]; ok {
+			g.DeleteLabelValues(values...)
+		}
+	})
+
+	if metricExported(t, registry, "munin_test_metric") {
+		t.Fatalf("expected metric to be expired after TTL")
+	}
+}
+
+func metricExported(t *testing.T, gatherer prometheus.Gatherer, name string) bool {
+	t.Helper()
+	mfs, err := gatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %s", err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() == name && len(mf.GetMetric()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// TestTTLTrackerTracksEachLabelSetIndependently covers a GaugeVec with two
+// series under the same metric name (e.g. sda/sdb under diskstats_usage):
+// one disk keeps reporting and must survive the sweep, the other stopped
+// and must expire, without either affecting the other.
+func TestTTLTrackerTracksEachLabelSetIndependently(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+
+	tracker := newTTLTracker()
+	tracker.now = clock.Now
+
+	registry := prometheus.NewRegistry()
+	gv := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "munin_test_metric", Help: "test"},
+		[]string{"hostname", "graphname", "muninlabel"},
+	)
+	registry.MustRegister(gv)
+
+	staleLabels := []string{"host", "graph", "sda"}
+	freshLabels := []string{"host", "graph", "sdb"}
+	gv.WithLabelValues(staleLabels...).Set(1)
+	gv.WithLabelValues(freshLabels...).Set(1)
+	tracker.markSeen("munin_test_metric", staleLabels)
+	tracker.markSeen("munin_test_metric", freshLabels)
+
+	clock.now = clock.now.Add(10 * time.Minute)
+	tracker.markSeen("munin_test_metric", freshLabels) // sdb keeps reporting
+
+	var expired [][]string
+	tracker.sweep(5*time.Minute, func(metric string, values []string) {
+		expired = append(expired, values)
+		gv.DeleteLabelValues(values...)
+	})
+
+	if len(expired) != 1 {
+		t.Fatalf("expected exactly one expired series, got %v", expired)
+	}
+
+	metrics := gatherLabelValues(t, registry, "munin_test_metric")
+	if len(metrics) != 1 || metrics[0]["muninlabel"] != "sdb" {
+		t.Fatalf("expected only sdb to remain, got %v", metrics)
+	}
+}
+
+func gatherLabelValues(t *testing.T, gatherer prometheus.Gatherer, name string) []map[string]string {
+	t.Helper()
+	mfs, err := gatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %s", err)
+	}
+	var out []map[string]string
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			out = append(out, labels)
+		}
+	}
+	return out
+}